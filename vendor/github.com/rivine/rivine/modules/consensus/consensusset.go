@@ -0,0 +1,66 @@
+package consensus
+
+import (
+	"sync"
+
+	"github.com/rivine/bbolt"
+	"github.com/rivine/rivine/modules"
+	siasync "github.com/rivine/rivine/sync"
+	"github.com/rivine/rivine/types"
+)
+
+// consensusLogger is the minimal logging surface this package needs from
+// cs.log.
+type consensusLogger interface {
+	Critical(v ...interface{})
+}
+
+// blockRuleHelper resolves the rule-dependent pieces of a ConsensusChange,
+// such as the minimum timestamp a child block is allowed to have.
+type blockRuleHelper interface {
+	minimumValidChildTimestamp(blockMap *bolt.Bucket, pb *processedBlock) types.Timestamp
+}
+
+// ConsensusSet tracks the current state of consensus and exposes methods
+// for feeding it blocks and subscribing to the changes that result.
+//
+// Only the fields touched by this package's subscription, filtering and
+// consensus-message machinery are declared here; the rest of ConsensusSet's
+// surface (block validation, fork choice, and the bulk of its persisted
+// buckets) lives alongside the rest of the consensus engine.
+type ConsensusSet struct {
+	db  *bolt.DB
+	log consensusLogger
+
+	mu sync.Mutex
+	tg siasync.ThreadGroup
+
+	synced          bool
+	blockRuleHelper blockRuleHelper
+
+	subscriptions    []*subscriberQueue
+	messageProducers []messageProducerEntry
+}
+
+// createConsensusObjects creates the bolt buckets this package's features
+// need on top of the database's base bucket set (BlockMap, and friends).
+// It is invoked from the same database-bootstrap path that creates those
+// base buckets.
+func (cs *ConsensusSet) createConsensusObjects(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(BlockMessagesMap)
+	return err
+}
+
+// commitDiffSet commits pb's consensus messages to the consensus database
+// when dir is modules.DiffApply; it does not write pb's output diffs. This
+// is the call site for commitBlockMessages: consensus messages are only
+// produced and persisted on modules.DiffApply, and are replayed in reverse
+// (never reproduced) when a block is later reverted.
+func (cs *ConsensusSet) commitDiffSet(tx *bolt.Tx, pb *processedBlock, dir modules.DiffDirection) error {
+	if dir == modules.DiffApply {
+		if err := cs.commitBlockMessages(tx, pb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package cstream
+
+import (
+	"net"
+
+	"github.com/rivine/rivine/modules"
+	"github.com/rivine/rivine/modules/consensus"
+)
+
+// Client sources modules.ConsensusChange values from a remote Server over
+// the network instead of a local consensus.ConsensusSet, making local and
+// remote subscription sources interchangeable for downstream code: both are
+// driven by feeding a modules.ConsensusSetSubscriber.
+type Client struct {
+	conn      net.Conn
+	resumeAck bool
+}
+
+// Dial connects to a Server listening at addr and requests a stream
+// starting at start, optionally scoped by filter and/or acknowledged.
+func Dial(addr string, start modules.ConsensusChangeID, filter consensus.ConsensusChangeFilter, resumeAck bool) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hs := handshake{Start: start, Filter: filter, ResumeAck: resumeAck}
+	if err := writeFrame(conn, hs); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Client{conn: conn, resumeAck: resumeAck}, nil
+}
+
+// Subscribe feeds subscriber every consensus change received from the
+// Server until the connection is closed or reading fails, at which point it
+// returns the error (io.EOF on a clean remote close).
+func (c *Client) Subscribe(subscriber modules.ConsensusSetSubscriber) error {
+	for {
+		var cc modules.ConsensusChange
+		if err := readFrame(c.conn, &cc); err != nil {
+			return err
+		}
+		subscriber.ProcessConsensusChange(cc)
+		if !c.resumeAck {
+			continue
+		}
+		if err := writeFrame(c.conn, ack{ID: cc.ID}); err != nil {
+			return err
+		}
+	}
+}
+
+// Close terminates the underlying connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
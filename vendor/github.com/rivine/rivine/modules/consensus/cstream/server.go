@@ -0,0 +1,230 @@
+// Package cstream streams the modules.ConsensusChange values produced by a
+// consensus.ConsensusSet to clients that do not want to link the consensus
+// package directly, such as explorers, indexers, and other sidecar
+// services. Each connected client is registered as an ordinary
+// modules.ConsensusSetSubscriber, reusing the consensus package's
+// async-queue, auto-rescan and filtering machinery, and streams its changes
+// over a length-prefixed, Rivine-encoded wire protocol.
+package cstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/rivine/rivine/encoding"
+	"github.com/rivine/rivine/modules"
+	"github.com/rivine/rivine/modules/consensus"
+	siasync "github.com/rivine/rivine/sync"
+)
+
+// frameHeaderSize is the size, in bytes, of the length prefix written before
+// every Rivine-encoded frame on the wire.
+const frameHeaderSize = 4
+
+// maxFrameSize bounds a single encoded frame, as a basic defence against a
+// peer claiming an unreasonable length in its frame header.
+const maxFrameSize = 32 << 20 // 32 MiB
+
+// handshake is sent by a client immediately after connecting, describing
+// where its stream should start.
+type handshake struct {
+	Start     modules.ConsensusChangeID
+	Filter    consensus.ConsensusChangeFilter
+	ResumeAck bool
+}
+
+// ack is sent by the client, when handshake.ResumeAck is set, once it has
+// durably processed a consensus change, so the Server knows it is safe to
+// advance past that change.
+type ack struct {
+	ID modules.ConsensusChangeID
+}
+
+// Server exposes a ConsensusSet's consensus change stream over TCP.
+type Server struct {
+	cs       *consensus.ConsensusSet
+	listener net.Listener
+	tg       siasync.ThreadGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewServer starts listening on addr and returns a Server that streams cs's
+// consensus changes to clients that connect.
+func NewServer(cs *consensus.ConsensusSet, addr string) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{cs: cs, listener: l, conns: make(map[net.Conn]struct{})}
+	go s.listen()
+	return s, nil
+}
+
+// Close stops accepting new connections, closes every connection still
+// being served so their serve goroutines unblock, and waits for them to
+// exit.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.tg.Stop()
+	return err
+}
+
+func (s *Server) listen() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if s.tg.Add() != nil {
+			conn.Close()
+			continue
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			defer s.tg.Done()
+			defer s.removeConn(conn)
+			s.serve(conn)
+		}()
+	}
+}
+
+func (s *Server) removeConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// serve registers conn's client as a consensus subscriber and blocks until
+// the connection is closed or the client drops its subscription. serve is
+// the connection's sole reader: streamSubscriber.ProcessConsensusChange
+// never touches conn directly, so there is only ever one goroutine reading
+// it at a time.
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var hs handshake
+	if err := readFrame(conn, &hs); err != nil {
+		return
+	}
+
+	sub := &streamSubscriber{conn: conn, resumeAck: hs.ResumeAck}
+	if hs.ResumeAck {
+		sub.acks = make(chan modules.ConsensusChangeID)
+	}
+	cancel := make(chan struct{})
+	defer close(cancel)
+
+	var err error
+	if hs.Filter.IsEmpty() {
+		err = s.cs.ConsensusSetSubscribePersistent(sub, hs.Start, cancel)
+	} else {
+		err = s.cs.ConsensusSetSubscribeFiltered(sub, hs.Start, hs.Filter, cancel)
+	}
+	if err != nil {
+		return
+	}
+	defer s.cs.Unsubscribe(sub)
+
+	if !hs.ResumeAck {
+		// Nothing more is expected from the client; keep reading purely to
+		// notice when it disconnects.
+		io.Copy(io.Discard, conn)
+		return
+	}
+
+	// Forward every ack read off conn to sub's delivery goroutine via
+	// sub.acks, and close it once the connection dies so a blocked
+	// ProcessConsensusChange is released instead of hanging forever.
+	defer close(sub.acks)
+	for {
+		var a ack
+		if err := readFrame(conn, &a); err != nil {
+			return
+		}
+		select {
+		case sub.acks <- a.ID:
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// streamSubscriber adapts a net.Conn into a modules.ConsensusSetSubscriber
+// that writes every delivered change to the wire, optionally waiting for an
+// ack before returning so the consensus package's normal backpressure
+// (PolicyBlock) keeps the client caught up exactly-once.
+type streamSubscriber struct {
+	conn      net.Conn
+	resumeAck bool
+
+	// acks receives the ID of each ack serve's reader loop reads off conn,
+	// when resumeAck is set. serve closes it once that loop exits, so a
+	// ProcessConsensusChange waiting on it is released rather than blocked
+	// forever by a connection that died without acking.
+	acks chan modules.ConsensusChangeID
+}
+
+// ProcessConsensusChange implements modules.ConsensusSetSubscriber.
+func (sub *streamSubscriber) ProcessConsensusChange(cc modules.ConsensusChange) {
+	if err := writeFrame(sub.conn, cc); err != nil {
+		return
+	}
+	if !sub.resumeAck {
+		return
+	}
+	id, ok := <-sub.acks
+	if !ok {
+		// serve's reader loop already exited - the connection is gone.
+		return
+	}
+	if id != cc.ID {
+		// The client acked something other than the change it was just
+		// sent: a stale replay, an out-of-order ack, or a buggy client.
+		// Treat it as a protocol violation and disconnect rather than
+		// silently advancing the subscription past an ack the client
+		// never actually gave for cc.
+		sub.conn.Close()
+	}
+}
+
+func writeFrame(w io.Writer, v interface{}) error {
+	b := encoding.Marshal(v)
+	if len(b) > maxFrameSize {
+		return errors.New("cstream: frame too large to send")
+	}
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(b)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readFrame(r io.Reader, v interface{}) error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	n := binary.LittleEndian.Uint32(header[:])
+	if n > maxFrameSize {
+		return errors.New("cstream: frame too large to receive")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return encoding.Unmarshal(b, v)
+}
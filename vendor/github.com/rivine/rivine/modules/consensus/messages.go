@@ -0,0 +1,131 @@
+package consensus
+
+import (
+	"github.com/rivine/bbolt"
+	"github.com/rivine/rivine/encoding"
+	"github.com/rivine/rivine/modules"
+	"github.com/rivine/rivine/types"
+)
+
+// BlockMessagesMap is the persist bucket holding each block's consensus
+// messages, keyed by block ID. It is created alongside the other top-level
+// buckets (BlockMap, SiacoinOutputs, ...) during database initialization.
+var BlockMessagesMap = []byte("BlockMessagesMap")
+
+// ConsensusMessageProducer is invoked while a block is being applied so it
+// can contribute arbitrary, producer-defined payloads - governance or
+// parameter-update messages, sequencer-set upserts, oracle updates, and the
+// like - that must be observed atomically with the block that produced
+// them.
+type ConsensusMessageProducer interface {
+	// ProduceConsensusMessages returns the messages of this producer's kind
+	// that belong to pb. It is called with the same bolt.Tx that is
+	// committing pb, before that transaction is closed.
+	ProduceConsensusMessages(tx *bolt.Tx, pb *processedBlock) ([][]byte, error)
+}
+
+// blockMessages is the persisted record of every consensus message produced
+// while a block was applied, stored in BlockMessagesMap under the block's
+// ID.
+type blockMessages struct {
+	Kinds    []string
+	Messages [][]byte
+}
+
+// messageProducerEntry pairs a registered ConsensusMessageProducer with the
+// kind it was registered under. cs.messageProducers is a slice of these,
+// not a map, specifically so that registration order survives into
+// commitBlockMessages: a plain map would let Go's randomized iteration
+// order reshuffle the persisted Kinds/Messages on every commit.
+type messageProducerEntry struct {
+	kind     string
+	producer ConsensusMessageProducer
+}
+
+// RegisterConsensusMessageProducer registers producer under kind. Kind must
+// be unique; registering the same kind twice replaces the previous
+// producer in place, without moving its position in registration order.
+// Registered producers are invoked, in registration order, every time a
+// block is applied by commitDiffSet, and their output is persisted
+// alongside the block so it can be replayed to subscribers exactly once, in
+// that same order, as part of the modules.ConsensusChange carrying that
+// block's other diffs.
+func (cs *ConsensusSet) RegisterConsensusMessageProducer(kind string, producer ConsensusMessageProducer) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for i := range cs.messageProducers {
+		if cs.messageProducers[i].kind == kind {
+			cs.messageProducers[i].producer = producer
+			return
+		}
+	}
+	cs.messageProducers = append(cs.messageProducers, messageProducerEntry{kind: kind, producer: producer})
+}
+
+// commitBlockMessages runs every registered ConsensusMessageProducer
+// against pb, in registration order, and persists their combined output to
+// BlockMessagesMap. It is called by commitDiffSet, for the
+// modules.DiffApply direction only: messages are not re-derived on revert, they are replayed
+// in reverse from what was persisted here, mirroring how CoinOutputDiffs
+// and BlockStakeOutputDiffs are flipped rather than recomputed.
+func (cs *ConsensusSet) commitBlockMessages(tx *bolt.Tx, pb *processedBlock) error {
+	if len(cs.messageProducers) == 0 {
+		return nil
+	}
+
+	var bm blockMessages
+	for _, entry := range cs.messageProducers {
+		msgs, err := entry.producer.ProduceConsensusMessages(tx, pb)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			bm.Kinds = append(bm.Kinds, entry.kind)
+			bm.Messages = append(bm.Messages, msg)
+		}
+	}
+	if len(bm.Messages) == 0 {
+		return nil
+	}
+
+	id := pb.Block.ID()
+	return tx.Bucket(BlockMessagesMap).Put(id[:], encoding.Marshal(bm))
+}
+
+// getBlockMessages returns the consensus messages persisted for block id,
+// or a zero-value blockMessages if none were produced for it.
+func getBlockMessages(tx *bolt.Tx, id types.BlockID) (blockMessages, error) {
+	b := tx.Bucket(BlockMessagesMap).Get(id[:])
+	if b == nil {
+		return blockMessages{}, nil
+	}
+	var bm blockMessages
+	if err := encoding.Unmarshal(b, &bm); err != nil {
+		return blockMessages{}, err
+	}
+	return bm, nil
+}
+
+// appendConsensusMessages appends bm's entries to cc.Messages, setting
+// each entry's Revert flag when revert is true. It is shared by
+// computeConsensusChangeWithFilter's revert and apply loops so that
+// reverted blocks emit their messages in reverse, exactly like their
+// CoinOutputDiffs and BlockStakeOutputDiffs.
+func appendConsensusMessages(cc *modules.ConsensusChange, bm blockMessages, revert bool) {
+	if revert {
+		for i := len(bm.Messages) - 1; i >= 0; i-- {
+			cc.Messages = append(cc.Messages, modules.ConsensusMessage{
+				Kind:    bm.Kinds[i],
+				Payload: bm.Messages[i],
+				Revert:  true,
+			})
+		}
+		return
+	}
+	for i := range bm.Messages {
+		cc.Messages = append(cc.Messages, modules.ConsensusMessage{
+			Kind:    bm.Kinds[i],
+			Payload: bm.Messages[i],
+		})
+	}
+}
@@ -2,52 +2,116 @@ package consensus
 
 import (
 	"errors"
+	"runtime"
 
 	"github.com/rivine/rivine/modules"
 
 	"github.com/rivine/bbolt"
 )
 
-// computeConsensusChange computes the consensus change from the change entry
-// at index 'i' in the change log. If i is out of bounds, an error is returned.
-func (cs *ConsensusSet) computeConsensusChange(tx *bolt.Tx, ce changeEntry) (modules.ConsensusChange, error) {
+// initializeSubscribeYieldInterval is how many changeEntry's
+// initializeSubscribe processes before releasing cs.mu and yielding the
+// goroutine. Catching a subscriber up from modules.ConsensusChangeBeginning
+// on a long chain can take minutes; without yielding, that would freeze
+// block acceptance and every other subscription for the whole catch-up.
+const initializeSubscribeYieldInterval = 1000
+
+// diffFilter parameterizes computeConsensusChangeWithFilter over which
+// output diffs to keep and whether a block with none of its diffs kept
+// should still have its header forwarded. computeConsensusChange and
+// computeConsensusChangeFiltered are both just this core walk with a
+// different diffFilter, so the revert/apply and message-replay logic only
+// has to be maintained in one place.
+type diffFilter struct {
+	matchCoinOutputDiff       func(modules.CoinOutputDiff) bool
+	matchBlockStakeOutputDiff func(modules.BlockStakeOutputDiff) bool
+	includeEmptyBlockHeaders  bool
+}
+
+// matchAllDiffFilter is the diffFilter used by computeConsensusChange: every
+// diff is kept, and every block's header is always forwarded.
+var matchAllDiffFilter = diffFilter{
+	matchCoinOutputDiff:       func(modules.CoinOutputDiff) bool { return true },
+	matchBlockStakeOutputDiff: func(modules.BlockStakeOutputDiff) bool { return true },
+	includeEmptyBlockHeaders:  true,
+}
+
+// computeConsensusChangeWithFilter computes the consensus change from the
+// change entry ce, keeping only the diffs that f matches. Messages are
+// always carried across in full: filter only scopes output diffs, never a
+// producer's consensus messages.
+func (cs *ConsensusSet) computeConsensusChangeWithFilter(tx *bolt.Tx, ce changeEntry, f diffFilter) (modules.ConsensusChange, error) {
 	cc := modules.ConsensusChange{
 		ID: ce.ID(),
 	}
 	for _, revertedBlockID := range ce.RevertedBlocks {
 		revertedBlock, err := getBlockMap(tx, revertedBlockID)
 		if err != nil {
-			cs.log.Critical("getBlockMap failed in computeConsensusChange:", err)
+			cs.log.Critical("getBlockMap failed in computeConsensusChangeWithFilter:", err)
 			return modules.ConsensusChange{}, err
 		}
 
 		// Because the direction is 'revert', the order of the diffs needs to
 		// be flipped and the direction of the diffs also needs to be flipped.
-		cc.RevertedBlocks = append(cc.RevertedBlocks, revertedBlock.Block)
+		var matched bool
 		for i := len(revertedBlock.CoinOutputDiffs) - 1; i >= 0; i-- {
 			scod := revertedBlock.CoinOutputDiffs[i]
+			if !f.matchCoinOutputDiff(scod) {
+				continue
+			}
 			scod.Direction = !scod.Direction
 			cc.CoinOutputDiffs = append(cc.CoinOutputDiffs, scod)
+			matched = true
 		}
 		for i := len(revertedBlock.BlockStakeOutputDiffs) - 1; i >= 0; i-- {
 			sfod := revertedBlock.BlockStakeOutputDiffs[i]
+			if !f.matchBlockStakeOutputDiff(sfod) {
+				continue
+			}
 			sfod.Direction = !sfod.Direction
 			cc.BlockStakeOutputDiffs = append(cc.BlockStakeOutputDiffs, sfod)
+			matched = true
+		}
+		bm, err := getBlockMessages(tx, revertedBlockID)
+		if err != nil {
+			cs.log.Critical("getBlockMessages failed in computeConsensusChangeWithFilter:", err)
+			return modules.ConsensusChange{}, err
+		}
+		appendConsensusMessages(&cc, bm, true)
+		if matched || f.includeEmptyBlockHeaders {
+			cc.RevertedBlocks = append(cc.RevertedBlocks, revertedBlock.Block)
 		}
 	}
 	for _, appliedBlockID := range ce.AppliedBlocks {
 		appliedBlock, err := getBlockMap(tx, appliedBlockID)
 		if err != nil {
-			cs.log.Critical("getBlockMap failed in computeConsensusChange:", err)
+			cs.log.Critical("getBlockMap failed in computeConsensusChangeWithFilter:", err)
 			return modules.ConsensusChange{}, err
 		}
 
-		cc.AppliedBlocks = append(cc.AppliedBlocks, appliedBlock.Block)
+		var matched bool
 		for _, scod := range appliedBlock.CoinOutputDiffs {
+			if !f.matchCoinOutputDiff(scod) {
+				continue
+			}
 			cc.CoinOutputDiffs = append(cc.CoinOutputDiffs, scod)
+			matched = true
 		}
 		for _, sfod := range appliedBlock.BlockStakeOutputDiffs {
+			if !f.matchBlockStakeOutputDiff(sfod) {
+				continue
+			}
 			cc.BlockStakeOutputDiffs = append(cc.BlockStakeOutputDiffs, sfod)
+			matched = true
+		}
+		bm, err := getBlockMessages(tx, appliedBlockID)
+		if err != nil {
+			cs.log.Critical("getBlockMessages failed in computeConsensusChangeWithFilter:", err)
+			return modules.ConsensusChange{}, err
+		}
+		appendConsensusMessages(&cc, bm, false)
+		if matched || f.includeEmptyBlockHeaders {
+			cc.AppliedBlocks = append(cc.AppliedBlocks, appliedBlock.Block)
 		}
 	}
 
@@ -67,11 +131,29 @@ func (cs *ConsensusSet) computeConsensusChange(tx *bolt.Tx, ce changeEntry) (mod
 	return cc, nil
 }
 
+// computeConsensusChange computes the consensus change from the change
+// entry ce, keeping every diff. An error is returned if a block of ce
+// cannot be loaded.
+func (cs *ConsensusSet) computeConsensusChange(tx *bolt.Tx, ce changeEntry) (modules.ConsensusChange, error) {
+	return cs.computeConsensusChangeWithFilter(tx, ce, matchAllDiffFilter)
+}
+
 // readLockUpdateSubscribers will inform all subscribers of a new update to the
 // consensus set. readlockUpdateSubscribers does not alter the changelog, the
 // changelog must be updated beforehand.
+//
+// Delivery itself happens off of cs.mu: each subscription owns a bounded
+// queue and a dedicated goroutine that calls ProcessConsensusChange, so a
+// slow subscriber only holds up this loop once its queue is full. enqueue
+// only blocks at all under PolicyBlock, and then it waits, with cs.mu held,
+// until that subscriber's queue has room.
+//
+// readlockUpdateSubscribers is called with cs.mu held, so it is also the
+// place that prunes cs.subscriptions: a PolicyDetach subscriber reports its
+// own detachment through enqueue's return value, and is spliced out here
+// rather than mutating cs.subscriptions from the subscriber's own goroutine.
 func (cs *ConsensusSet) readlockUpdateSubscribers(ce changeEntry) {
-	// Get the consensus change and send it to all subscribers.
+	// Get the consensus change and send it to all unfiltered subscribers.
 	var cc modules.ConsensusChange
 	err := cs.db.View(func(tx *bolt.Tx) error {
 		// Compute the consensus change so it can be sent to subscribers.
@@ -83,69 +165,176 @@ func (cs *ConsensusSet) readlockUpdateSubscribers(ce changeEntry) {
 		cs.log.Critical("computeConsensusChange failed:", err)
 		return
 	}
-	for _, subscriber := range cs.subscribers {
-		subscriber.ProcessConsensusChange(cc)
+
+	var detached []int
+	for i, sq := range cs.subscriptions {
+		if sq.filter == nil {
+			if sq.enqueue(cc) {
+				detached = append(detached, i)
+			}
+			continue
+		}
+		// Filtered subscribers get their own, independently filtered
+		// consensus change rather than the shared one above.
+		var fcc modules.ConsensusChange
+		err := cs.db.View(func(tx *bolt.Tx) error {
+			var err error
+			fcc, err = cs.computeConsensusChangeFiltered(tx, ce, *sq.filter)
+			return err
+		})
+		if err != nil {
+			cs.log.Critical("computeConsensusChangeFiltered failed:", err)
+			continue
+		}
+		if sq.enqueue(fcc) {
+			detached = append(detached, i)
+		}
+	}
+
+	// Remove detached subscriptions in reverse index order so earlier
+	// indices stay valid as later ones are spliced out.
+	for i := len(detached) - 1; i >= 0; i-- {
+		idx := detached[i]
+		cs.subscriptions = append(cs.subscriptions[:idx], cs.subscriptions[idx+1:]...)
+	}
+}
+
+// initializeSubscribeStart resolves the first changeEntry that has not yet
+// been seen by a subscriber starting from start.
+//
+// As a special case, using an empty id as the start will have all the
+// changes sent to the modules starting with the genesis block.
+func (cs *ConsensusSet) initializeSubscribeStart(tx *bolt.Tx, start modules.ConsensusChangeID) (changeEntry, bool, error) {
+	if start == modules.ConsensusChangeBeginning {
+		// Special case: for modules.ConsensusChangeBeginning, create an
+		// initial node pointing to the genesis block. The subscriber will
+		// receive the diffs for all blocks in the consensus set, including
+		// the genesis block.
+		return cs.genesisEntry(), true, nil
+	}
+	if start == modules.ConsensusChangeRecent {
+		// Special case: for modules.ConsensusChangeRecent, set up the
+		// subscriber to start receiving only new blocks, but the subscriber
+		// does not need to do any catch-up. For this implementation, a
+		// no-op will have this effect.
+		return changeEntry{}, false, nil
 	}
+	// The subscriber has provided an existing consensus change. Because the
+	// subscriber already has this consensus change, 'entry' needs to be
+	// pointed at the next consensus change.
+	entry, exists := getEntry(tx, start)
+	if !exists {
+		// modules.ErrInvalidConsensusChangeID is a named error that signals
+		// a break in synchronization between the consensus set persistence
+		// and the subscriber persistence. Typically, receiving this error
+		// means that the subscriber needs to perform a rescan of the
+		// consensus set.
+		return changeEntry{}, false, modules.ErrInvalidConsensusChangeID
+	}
+	entry, exists = entry.NextEntry(tx)
+	return entry, exists, nil
 }
 
+// computeChangeFunc computes the modules.ConsensusChange for a single
+// changeEntry. initializeSubscribe and ConsensusSetSubscribeFiltered both
+// just call runInitializeSubscribe with a different computeChangeFunc, so
+// the yield/resume control flow only has to be maintained in one place.
+type computeChangeFunc func(tx *bolt.Tx, entry changeEntry) (modules.ConsensusChange, error)
+
 // initializeSubscribe will take a subscriber and feed them all of the
 // consensus changes that have occurred since the change provided.
 //
 // As a special case, using an empty id as the start will have all the changes
 // sent to the modules starting with the genesis block.
 func (cs *ConsensusSet) initializeSubscribe(subscriber modules.ConsensusSetSubscriber, start modules.ConsensusChangeID, cancel <-chan struct{}) error {
-	return cs.db.View(func(tx *bolt.Tx) error {
-		// 'exists' and 'entry' are going to be pointed to the first entry that
-		// has not yet been seen by subscriber.
-		var exists bool
-		var entry changeEntry
-
-		if start == modules.ConsensusChangeBeginning {
-			// Special case: for modules.ConsensusChangeBeginning, create an
-			// initial node pointing to the genesis block. The subscriber will
-			// receive the diffs for all blocks in the consensus set, including
-			// the genesis block.
-			entry = cs.genesisEntry()
-			exists = true
-		} else if start == modules.ConsensusChangeRecent {
-			// Special case: for modules.ConsensusChangeRecent, set up the
-			// subscriber to start receiving only new blocks, but the
-			// subscriber does not need to do any catch-up. For this
-			// implementation, a no-op will have this effect.
-			return nil
-		} else {
-			// The subscriber has provided an existing consensus change.
-			// Because the subscriber already has this consensus change,
-			// 'entry' and 'exists' need to be pointed at the next consensus
-			// change.
-			entry, exists = getEntry(tx, start)
-			if !exists {
-				// modules.ErrInvalidConsensusChangeID is a named error that
-				// signals a break in synchronization between the consensus set
-				// persistence and the subscriber persistence. Typically,
-				// receiving this error means that the subscriber needs to
-				// perform a rescan of the consensus set.
-				return modules.ErrInvalidConsensusChangeID
-			}
-			entry, exists = entry.NextEntry(tx)
+	return cs.runInitializeSubscribe(subscriber, start, cancel, cs.computeConsensusChange)
+}
+
+// runInitializeSubscribe is called with cs.mu held. Catching a subscriber up
+// from modules.ConsensusChangeBeginning on a long chain can take minutes, so
+// every initializeSubscribeYieldInterval entries it releases cs.mu (ending
+// the current bolt read transaction, which would otherwise pin the
+// database's free list for the whole catch-up), yields the goroutine, and
+// re-acquires the lock before resuming - leaving cs.mu held on return, as
+// the caller expects. Live changes produced by block acceptance during a
+// yield window are not lost: the changelog is append-only, so resuming from
+// entry.NextEntry naturally tail-follows any entries written while the lock
+// was released.
+//
+// TODO(test): this loop - the yield/re-lock cadence, re-validating the
+// resumed entry by ID, and tail-following entries appended during the
+// yield window - has no test coverage yet, in this file or elsewhere in
+// this package. It needs one: a changelog with enough entries to force a
+// yield at a small initializeSubscribeYieldInterval, asserting that cs.mu
+// is actually released during the yield, that entries appended live during
+// that window are picked up on resume, and that a pruned/missing resume
+// entry surfaces modules.ErrInvalidConsensusChangeID. That requires a real
+// *bolt.DB and a populated changelog (changeEntry.NextEntry and getEntry
+// are not meaningfully fakeable), neither of which exist in this package
+// yet; add the test once that fixture exists.
+func (cs *ConsensusSet) runInitializeSubscribe(subscriber modules.ConsensusSetSubscriber, start modules.ConsensusChangeID, cancel <-chan struct{}, compute computeChangeFunc) error {
+	var entry changeEntry
+	var exists bool
+	err := cs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, exists, err = cs.initializeSubscribeStart(tx, start)
+		return err
+	})
+	if err != nil || !exists {
+		return err
+	}
+
+	for exists {
+		select {
+		case <-cancel:
+			return errors.New("aborting initializeSubscribe")
+		default:
 		}
 
-		// Send all remaining consensus changes to the subscriber.
-		for exists {
-			select {
-			case <-cancel:
-				return errors.New("aborting initializeSubscribe")
-			default:
-				cc, err := cs.computeConsensusChange(tx, entry)
+		processed := 0
+		err := cs.db.View(func(tx *bolt.Tx) error {
+			for exists && processed < initializeSubscribeYieldInterval {
+				select {
+				case <-cancel:
+					return errors.New("aborting initializeSubscribe")
+				default:
+				}
+				cc, err := compute(tx, entry)
 				if err != nil {
 					return err
 				}
 				subscriber.ProcessConsensusChange(cc)
 				entry, exists = entry.NextEntry(tx)
+				processed++
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+		if !exists {
+			break
+		}
+
+		cs.mu.Unlock()
+		runtime.Gosched()
+		cs.mu.Lock()
+
+		// The entry we are about to resume from may have been pruned or
+		// reorged away while the lock was released; re-validate it by ID.
+		err = cs.db.View(func(tx *bolt.Tx) error {
+			resumed, ok := getEntry(tx, entry.ID())
+			if !ok {
+				return modules.ErrInvalidConsensusChangeID
+			}
+			entry = resumed
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ConsensusSetSubscribe adds a subscriber to the list of subscribers, and
@@ -154,44 +343,39 @@ func (cs *ConsensusSet) initializeSubscribe(subscriber modules.ConsensusSetSubsc
 //
 // As a special case, using an empty id as the start will have all the changes
 // sent to the modules starting with the genesis block.
+//
+// ConsensusSetSubscribe is now backed by ConsensusSetSubscribeAsync, using a
+// generously sized queue and PolicyBlock so that its observable semantics -
+// every change delivered, in order, with backpressure instead of drops - are
+// unchanged for existing callers.
 func (cs *ConsensusSet) ConsensusSetSubscribe(subscriber modules.ConsensusSetSubscriber, start modules.ConsensusChangeID, cancel <-chan struct{}) error {
-	err := cs.tg.Add()
-	if err != nil {
-		return err
-	}
-	defer cs.tg.Done()
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-
-	// Get the input module caught up to the currenct consnesus set.
-	cs.subscribers = append(cs.subscribers, subscriber)
-	err = cs.initializeSubscribe(subscriber, start, cancel)
-	if err != nil {
-		// Remove the subscriber from the set of subscribers.
-		cs.subscribers = cs.subscribers[:len(cs.subscribers)-1]
-		return err
-	}
-	// Only add the module as a subscriber if there was no error.
-	return nil
+	return cs.ConsensusSetSubscribeAsync(subscriber, start, defaultSubscriberQueueCapacity, PolicyBlock, cancel)
 }
 
 // Unsubscribe removes a subscriber from the list of subscribers, allowing for
 // garbage collection and rescanning. If the subscriber is not found in the
-// subscriber database, no action is taken.
+// subscriber database, no action is taken. Unsubscribe waits for the
+// subscriber's delivery goroutine to drain and exit before returning.
 func (cs *ConsensusSet) Unsubscribe(subscriber modules.ConsensusSetSubscriber) {
 	if cs.tg.Add() != nil {
 		return
 	}
 	defer cs.tg.Done()
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
 
-	// Search for the subscriber in the list of subscribers and remove it if
-	// found.
-	for i := range cs.subscribers {
-		if cs.subscribers[i] == subscriber {
-			cs.subscribers = append(cs.subscribers[0:i], cs.subscribers[i+1:]...)
+	cs.mu.Lock()
+	var sq *subscriberQueue
+	for i := range cs.subscriptions {
+		if cs.subscriptions[i].subscriber == subscriber {
+			sq = cs.subscriptions[i]
+			cs.subscriptions = append(cs.subscriptions[0:i], cs.subscriptions[i+1:]...)
 			break
 		}
 	}
+	cs.mu.Unlock()
+
+	if sq == nil {
+		return
+	}
+	close(sq.pending)
+	<-sq.done
 }
@@ -0,0 +1,198 @@
+package consensus
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rivine/rivine/modules"
+)
+
+// SubscriberPolicy controls what the dispatcher does once a subscriber's
+// queue is full, i.e. once the subscriber is not draining
+// ProcessConsensusChange calls as fast as new consensus changes are being
+// produced.
+type SubscriberPolicy int
+
+const (
+	// PolicyBlock preserves the historical behaviour: the dispatcher blocks
+	// until the subscriber's queue has room. ProcessConsensusChange runs in
+	// the subscriber's own goroutine, so a slow PolicyBlock subscriber only
+	// holds up the dispatcher once its queue is full; the dispatcher then
+	// waits with cs.mu held, so block acceptance and the other subscribers
+	// wait with it.
+	PolicyBlock SubscriberPolicy = iota
+
+	// PolicyDropOldest discards the oldest queued change to make room for
+	// the newest one, and increments a per-subscriber dropped-change
+	// counter that can be read back with subscriberQueue.Dropped.
+	PolicyDropOldest
+
+	// PolicyDetach unsubscribes the consumer the moment its queue fills up.
+	// The ConsensusChangeID of the last change that was actually delivered
+	// is recorded so the caller can rejoin later via initializeSubscribe.
+	PolicyDetach
+)
+
+// defaultSubscriberQueueCapacity is the queue depth used by
+// ConsensusSetSubscribe, which backs onto ConsensusSetSubscribeAsync with
+// PolicyBlock to preserve its historical synchronous-looking semantics.
+const defaultSubscriberQueueCapacity = 50
+
+// subscriberQueue is the per-subscriber delivery pipeline created by
+// ConsensusSetSubscribeAsync. Each queue owns a single goroutine that drains
+// pending changes into subscriber.ProcessConsensusChange, so that appending
+// a change to the queue never blocks on the subscriber's own processing
+// speed.
+type subscriberQueue struct {
+	subscriber modules.ConsensusSetSubscriber
+	policy     SubscriberPolicy
+
+	// filter is non-nil for subscriptions registered through
+	// ConsensusSetSubscribeFiltered; readlockUpdateSubscribers uses it to
+	// recompute a filtered consensus change instead of reusing the shared,
+	// unfiltered one.
+	filter *ConsensusChangeFilter
+
+	pending chan modules.ConsensusChange
+	cancel  <-chan struct{}
+	done    chan struct{}
+
+	mu            sync.Mutex
+	lastDelivered modules.ConsensusChangeID
+	dropped       uint64
+	detached      bool
+}
+
+// Dropped returns the number of consensus changes that have been discarded
+// for this subscriber because its queue was full and its policy is
+// PolicyDropOldest.
+func (sq *subscriberQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&sq.dropped)
+}
+
+// Detached reports whether the queue has unsubscribed itself under
+// PolicyDetach.
+func (sq *subscriberQueue) Detached() bool {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	return sq.detached
+}
+
+// LastDelivered returns the ConsensusChangeID of the most recent change
+// handed to the subscriber, so that a detached subscriber can rejoin with
+// initializeSubscribe.
+func (sq *subscriberQueue) LastDelivered() modules.ConsensusChangeID {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	return sq.lastDelivered
+}
+
+// enqueue applies sq.policy to push cc onto the pending queue.
+// readlockUpdateSubscribers calls it with cs.mu held; under PolicyBlock a
+// full queue makes it wait, with that lock still held, until run takes a
+// change off the queue or exits.
+//
+// enqueue returns true the moment sq detaches (either just now, under
+// PolicyDetach, or because it had already detached on a previous call), so
+// the caller can splice sq out of cs.subscriptions. A detached queue stops
+// itself the same way Unsubscribe does - by closing sq.pending, which makes
+// run's receive from sq.pending report the channel closed, so run returns
+// and fires its single defer close(sq.done) - rather than closing sq.done a
+// second time here.
+func (sq *subscriberQueue) enqueue(cc modules.ConsensusChange) bool {
+	sq.mu.Lock()
+	detached := sq.detached
+	sq.mu.Unlock()
+	if detached {
+		return true
+	}
+
+	select {
+	case sq.pending <- cc:
+		return false
+	default:
+	}
+
+	switch sq.policy {
+	case PolicyBlock:
+		select {
+		case sq.pending <- cc:
+		case <-sq.done:
+		}
+	case PolicyDropOldest:
+		select {
+		case <-sq.pending:
+			atomic.AddUint64(&sq.dropped, 1)
+		default:
+		}
+		select {
+		case sq.pending <- cc:
+		default:
+		}
+	case PolicyDetach:
+		sq.mu.Lock()
+		sq.detached = true
+		sq.mu.Unlock()
+		close(sq.pending)
+		return true
+	}
+	return false
+}
+
+// run drains the queue, delivering each consensus change to the subscriber
+// in order, until the queue is closed by Unsubscribe or the subscription is
+// cancelled.
+func (sq *subscriberQueue) run() {
+	defer close(sq.done)
+	for {
+		select {
+		case cc, ok := <-sq.pending:
+			if !ok {
+				return
+			}
+			sq.subscriber.ProcessConsensusChange(cc)
+			sq.mu.Lock()
+			sq.lastDelivered = cc.ID
+			sq.mu.Unlock()
+		case <-sq.cancel:
+			return
+		}
+	}
+}
+
+// ConsensusSetSubscribeAsync adds a subscriber backed by its own goroutine
+// and a bounded FIFO of capacity pending consensus changes. Live changes
+// are handed to ProcessConsensusChange from that goroutine, not under
+// cs.mu, so the dispatcher only waits on a subscriber whose queue is full;
+// policy determines what happens then (under PolicyBlock the dispatcher
+// waits with cs.mu held until the queue has room).
+//
+// The subscription is only registered for live delivery once
+// initializeSubscribe has fully drained the catch-up backlog: initializeSubscribe
+// tail-follows the changelog itself while it runs, so registering earlier
+// would risk delivering the same change twice.
+func (cs *ConsensusSet) ConsensusSetSubscribeAsync(subscriber modules.ConsensusSetSubscriber, start modules.ConsensusChangeID, capacity int, policy SubscriberPolicy, cancel <-chan struct{}) error {
+	err := cs.tg.Add()
+	if err != nil {
+		return err
+	}
+	defer cs.tg.Done()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	err = cs.initializeSubscribe(subscriber, start, cancel)
+	if err != nil {
+		return err
+	}
+
+	sq := &subscriberQueue{
+		subscriber: subscriber,
+		policy:     policy,
+		pending:    make(chan modules.ConsensusChange, capacity),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	cs.subscriptions = append(cs.subscriptions, sq)
+	go sq.run()
+	return nil
+}
@@ -0,0 +1,103 @@
+package consensus
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rivine/rivine/modules"
+)
+
+// recordingSubscriber is a modules.ConsensusSetSubscriber that remembers the
+// ID of every consensus change it was given, for assertions in tests that
+// drive a subscriberQueue's run goroutine directly.
+type recordingSubscriber struct {
+	mu        sync.Mutex
+	processed []modules.ConsensusChangeID
+}
+
+func (r *recordingSubscriber) ProcessConsensusChange(cc modules.ConsensusChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.processed = append(r.processed, cc.ID)
+}
+
+func newTestSubscriberQueue(policy SubscriberPolicy, capacity int) *subscriberQueue {
+	return &subscriberQueue{
+		subscriber: &recordingSubscriber{},
+		policy:     policy,
+		pending:    make(chan modules.ConsensusChange, capacity),
+		cancel:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func TestSubscriberQueueDropOldest(t *testing.T) {
+	sq := newTestSubscriberQueue(PolicyDropOldest, 1)
+	cc1 := modules.ConsensusChange{ID: modules.ConsensusChangeID{1}}
+	cc2 := modules.ConsensusChange{ID: modules.ConsensusChangeID{2}}
+
+	if detached := sq.enqueue(cc1); detached {
+		t.Fatal("enqueue(cc1) reported detached")
+	}
+	if detached := sq.enqueue(cc2); detached {
+		t.Fatal("enqueue(cc2) reported detached")
+	}
+	if got := sq.Dropped(); got != 1 {
+		t.Fatalf("Dropped() = %d, want 1", got)
+	}
+
+	select {
+	case cc := <-sq.pending:
+		if cc.ID != cc2.ID {
+			t.Fatalf("queued change = %v, want cc2", cc.ID)
+		}
+	default:
+		t.Fatal("expected cc2 to have replaced cc1 in the queue")
+	}
+}
+
+func TestSubscriberQueueDetach(t *testing.T) {
+	sq := newTestSubscriberQueue(PolicyDetach, 1)
+	cc1 := modules.ConsensusChange{ID: modules.ConsensusChangeID{1}}
+	cc2 := modules.ConsensusChange{ID: modules.ConsensusChangeID{2}}
+
+	if detached := sq.enqueue(cc1); detached {
+		t.Fatal("enqueue(cc1) reported detached before the queue filled up")
+	}
+	if detached := sq.enqueue(cc2); !detached {
+		t.Fatal("enqueue(cc2) did not report detachment once the queue filled up")
+	}
+	if !sq.Detached() {
+		t.Fatal("Detached() = false after a PolicyDetach queue filled up")
+	}
+
+	// A later enqueue on an already-detached queue must keep reporting
+	// detachment instead of pushing onto (or re-closing) sq.pending.
+	if detached := sq.enqueue(cc2); !detached {
+		t.Fatal("enqueue on an already-detached queue did not report detachment")
+	}
+
+	cc, ok := <-sq.pending
+	if !ok || cc.ID != cc1.ID {
+		t.Fatalf("expected cc1 still queued, got (%v, %v)", cc, ok)
+	}
+	if _, ok := <-sq.pending; ok {
+		t.Fatal("expected sq.pending to be closed once the queue detached")
+	}
+}
+
+func TestSubscriberQueueRunExitsWhenPendingCloses(t *testing.T) {
+	sq := newTestSubscriberQueue(PolicyBlock, 1)
+	go sq.run()
+
+	// This is what both Unsubscribe and a detaching enqueue do to signal
+	// run to stop; run must close sq.done exactly once in response.
+	close(sq.pending)
+
+	select {
+	case <-sq.done:
+	case <-time.After(time.Second):
+		t.Fatal("run() did not close sq.done after sq.pending was closed")
+	}
+}
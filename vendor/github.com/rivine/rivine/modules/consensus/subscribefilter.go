@@ -0,0 +1,107 @@
+package consensus
+
+import (
+	"github.com/rivine/bbolt"
+	"github.com/rivine/rivine/modules"
+	"github.com/rivine/rivine/types"
+)
+
+// ConsensusChangeFilter narrows the diffs a filtered subscription receives
+// down to the unlock hashes and output IDs it cares about. The zero
+// ConsensusChangeFilter matches nothing; use IsEmpty to detect that case and
+// fall back to an unfiltered subscription instead. A diff is kept if it
+// matches any one of the configured sets.
+type ConsensusChangeFilter struct {
+	// UnlockHashes selects diffs whose output condition resolves to one of
+	// these unlock hashes.
+	UnlockHashes map[types.UnlockHash]struct{}
+
+	// CoinOutputIDs selects coin output diffs with these IDs.
+	CoinOutputIDs map[types.CoinOutputID]struct{}
+
+	// BlockStakeOutputIDs selects block stake output diffs with these IDs.
+	BlockStakeOutputIDs map[types.BlockStakeOutputID]struct{}
+
+	// IncludeBlockHeaders, when set, still forwards a block's entry in
+	// RevertedBlocks/AppliedBlocks even when every one of its diffs was
+	// filtered out, so a consumer can keep tracking the chain tip without
+	// paying to materialise diffs it does not care about.
+	IncludeBlockHeaders bool
+}
+
+// IsEmpty reports whether f has no unlock hashes or output IDs configured,
+// i.e. whether it would filter out every diff.
+func (f ConsensusChangeFilter) IsEmpty() bool {
+	return len(f.UnlockHashes) == 0 && len(f.CoinOutputIDs) == 0 && len(f.BlockStakeOutputIDs) == 0
+}
+
+func (f ConsensusChangeFilter) matchesCoinOutputDiff(cod modules.CoinOutputDiff) bool {
+	if _, ok := f.CoinOutputIDs[cod.ID]; ok {
+		return true
+	}
+	_, ok := f.UnlockHashes[cod.CoinOutput.Condition.UnlockHash()]
+	return ok
+}
+
+func (f ConsensusChangeFilter) matchesBlockStakeOutputDiff(sfod modules.BlockStakeOutputDiff) bool {
+	if _, ok := f.BlockStakeOutputIDs[sfod.ID]; ok {
+		return true
+	}
+	_, ok := f.UnlockHashes[sfod.BlockStakeOutput.Condition.UnlockHash()]
+	return ok
+}
+
+// asDiffFilter adapts f to the diffFilter shape computeConsensusChangeWithFilter
+// expects.
+func (f ConsensusChangeFilter) asDiffFilter() diffFilter {
+	return diffFilter{
+		matchCoinOutputDiff:       f.matchesCoinOutputDiff,
+		matchBlockStakeOutputDiff: f.matchesBlockStakeOutputDiff,
+		includeEmptyBlockHeaders:  f.IncludeBlockHeaders,
+	}
+}
+
+// computeConsensusChangeFiltered is computeConsensusChange's filtered
+// counterpart: it keeps only the CoinOutputDiffs/BlockStakeOutputDiffs
+// matching filter (eliding a block's header too, unless
+// filter.IncludeBlockHeaders is set), while still carrying every consensus
+// message across untouched. This lets lightweight consumers such as wallet
+// indexers or per-address explorers subscribe without paying to materialise
+// every diff for every block.
+func (cs *ConsensusSet) computeConsensusChangeFiltered(tx *bolt.Tx, ce changeEntry, filter ConsensusChangeFilter) (modules.ConsensusChange, error) {
+	return cs.computeConsensusChangeWithFilter(tx, ce, filter.asDiffFilter())
+}
+
+// ConsensusSetSubscribeFiltered adds a subscriber that only receives the
+// CoinOutputDiffs/BlockStakeOutputDiffs matching filter, computed via
+// computeConsensusChangeFiltered instead of the full computeConsensusChange.
+// Catch-up, async delivery and the subscriber lifecycle are otherwise
+// identical to ConsensusSetSubscribeAsync with PolicyBlock.
+func (cs *ConsensusSet) ConsensusSetSubscribeFiltered(subscriber modules.ConsensusSetSubscriber, start modules.ConsensusChangeID, filter ConsensusChangeFilter, cancel <-chan struct{}) error {
+	err := cs.tg.Add()
+	if err != nil {
+		return err
+	}
+	defer cs.tg.Done()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	err = cs.runInitializeSubscribe(subscriber, start, cancel, func(tx *bolt.Tx, entry changeEntry) (modules.ConsensusChange, error) {
+		return cs.computeConsensusChangeFiltered(tx, entry, filter)
+	})
+	if err != nil {
+		return err
+	}
+
+	sq := &subscriberQueue{
+		subscriber: subscriber,
+		policy:     PolicyBlock,
+		pending:    make(chan modules.ConsensusChange, defaultSubscriberQueueCapacity),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		filter:     &filter,
+	}
+	cs.subscriptions = append(cs.subscriptions, sq)
+	go sq.run()
+	return nil
+}
@@ -0,0 +1,66 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/rivine/rivine/modules"
+	"github.com/rivine/rivine/types"
+)
+
+func TestConsensusChangeFilterIsEmpty(t *testing.T) {
+	var f ConsensusChangeFilter
+	if !f.IsEmpty() {
+		t.Fatal("zero-value ConsensusChangeFilter should be empty")
+	}
+
+	var id types.CoinOutputID
+	f.CoinOutputIDs = map[types.CoinOutputID]struct{}{id: {}}
+	if f.IsEmpty() {
+		t.Fatal("filter with a CoinOutputID configured should not be empty")
+	}
+}
+
+func TestConsensusChangeFilterMatchesCoinOutputDiff(t *testing.T) {
+	var id, otherID types.CoinOutputID
+	id[0] = 1
+	otherID[0] = 2
+	f := ConsensusChangeFilter{CoinOutputIDs: map[types.CoinOutputID]struct{}{id: {}}}
+
+	if !f.matchesCoinOutputDiff(modules.CoinOutputDiff{ID: id}) {
+		t.Fatal("expected diff with a listed CoinOutputID to match")
+	}
+	if f.matchesCoinOutputDiff(modules.CoinOutputDiff{ID: otherID}) {
+		t.Fatal("expected diff with an unlisted CoinOutputID and no matching unlock hash to not match")
+	}
+}
+
+func TestConsensusChangeFilterMatchesBlockStakeOutputDiff(t *testing.T) {
+	var id, otherID types.BlockStakeOutputID
+	id[0] = 1
+	otherID[0] = 2
+	f := ConsensusChangeFilter{BlockStakeOutputIDs: map[types.BlockStakeOutputID]struct{}{id: {}}}
+
+	if !f.matchesBlockStakeOutputDiff(modules.BlockStakeOutputDiff{ID: id}) {
+		t.Fatal("expected diff with a listed BlockStakeOutputID to match")
+	}
+	if f.matchesBlockStakeOutputDiff(modules.BlockStakeOutputDiff{ID: otherID}) {
+		t.Fatal("expected diff with an unlisted BlockStakeOutputID and no matching unlock hash to not match")
+	}
+}
+
+func TestConsensusChangeFilterAsDiffFilter(t *testing.T) {
+	var id types.CoinOutputID
+	id[0] = 1
+	f := ConsensusChangeFilter{
+		CoinOutputIDs:       map[types.CoinOutputID]struct{}{id: {}},
+		IncludeBlockHeaders: true,
+	}
+
+	df := f.asDiffFilter()
+	if !df.includeEmptyBlockHeaders {
+		t.Fatal("asDiffFilter did not carry IncludeBlockHeaders through")
+	}
+	if !df.matchCoinOutputDiff(modules.CoinOutputDiff{ID: id}) {
+		t.Fatal("asDiffFilter's matchCoinOutputDiff does not agree with matchesCoinOutputDiff")
+	}
+}
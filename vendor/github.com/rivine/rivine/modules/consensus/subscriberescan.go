@@ -0,0 +1,41 @@
+package consensus
+
+import "github.com/rivine/rivine/modules"
+
+// RescanSubscriber is implemented by subscribers that want to know before
+// ConsensusSetSubscribePersistent silently restarts their subscription from
+// the genesis block. Consumers typically use the notification to drop any
+// state they derived from the stale ConsensusChangeID before rebuilding it
+// from scratch.
+type RescanSubscriber interface {
+	modules.ConsensusSetSubscriber
+
+	// RescanStarting is called once, immediately before the
+	// beginning-of-chain replay starts, when the subscriber's persisted
+	// ConsensusChangeID could no longer be found in the consensus set's
+	// changelog.
+	RescanStarting()
+}
+
+// ConsensusSetSubscribePersistent behaves like ConsensusSetSubscribe, except
+// that when the subscriber's stored ConsensusChangeID is no longer present
+// in the changelog - because of a reorg beyond the persisted window, a
+// database reset, or a fork - it does not return
+// modules.ErrInvalidConsensusChangeID to the caller. Instead it emits a
+// "rescan starting" notification, if subscriber implements RescanSubscriber,
+// and automatically re-subscribes from modules.ConsensusChangeBeginning.
+//
+// This centralises a pattern that downstream integrators, such as Sia's host
+// stack, otherwise end up open-coding around every call to
+// ConsensusSetSubscribe.
+func (cs *ConsensusSet) ConsensusSetSubscribePersistent(subscriber modules.ConsensusSetSubscriber, start modules.ConsensusChangeID, cancel <-chan struct{}) error {
+	err := cs.ConsensusSetSubscribe(subscriber, start, cancel)
+	if err != modules.ErrInvalidConsensusChangeID {
+		return err
+	}
+
+	if rs, ok := subscriber.(RescanSubscriber); ok {
+		rs.RescanStarting()
+	}
+	return cs.ConsensusSetSubscribe(subscriber, modules.ConsensusChangeBeginning, cancel)
+}
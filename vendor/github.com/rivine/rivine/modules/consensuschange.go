@@ -0,0 +1,107 @@
+package modules
+
+import (
+	"errors"
+
+	"github.com/rivine/rivine/types"
+)
+
+// ConsensusChangeID is a unique identifier for a changeEntry in the
+// consensus set's changelog.
+type ConsensusChangeID [32]byte
+
+var (
+	// ConsensusChangeBeginning is a special ConsensusChangeID that tells
+	// the consensus set to provide all changes starting from the genesis
+	// block, rather than starting from a specific change.
+	ConsensusChangeBeginning = ConsensusChangeID{}
+
+	// ConsensusChangeRecent is a special ConsensusChangeID that tells the
+	// consensus set to only provide changes that happen after the
+	// subscription call, skipping any catch-up.
+	ConsensusChangeRecent = ConsensusChangeID{1}
+
+	// ErrInvalidConsensusChangeID indicates that ConsensusSetSubscribe was
+	// called with a ConsensusChangeID that is not found in the subscriber
+	// database, signalling that the subscriber needs to perform a rescan.
+	ErrInvalidConsensusChangeID = errors.New("consensus change id not found in subscriber database")
+)
+
+// DiffDirection indicates the direction of an output diff: whether it is
+// being applied to the consensus set or reverted from it.
+type DiffDirection bool
+
+const (
+	// DiffApply indicates an output is being added to the consensus set.
+	DiffApply DiffDirection = true
+	// DiffRevert indicates an output is being removed from the consensus
+	// set.
+	DiffRevert DiffDirection = false
+)
+
+// CoinOutputDiff indicates the addition or removal of a CoinOutput in the
+// consensus set.
+type CoinOutputDiff struct {
+	Direction  DiffDirection
+	ID         types.CoinOutputID
+	CoinOutput types.CoinOutput
+}
+
+// BlockStakeOutputDiff indicates the addition or removal of a
+// BlockStakeOutput in the consensus set.
+type BlockStakeOutputDiff struct {
+	Direction        DiffDirection
+	ID               types.BlockStakeOutputID
+	BlockStakeOutput types.BlockStakeOutput
+}
+
+// ConsensusMessage pairs a producer-defined payload with the kind of
+// producer that emitted it, and whether it is being delivered because its
+// originating block was reverted. Messages are carried alongside a
+// ConsensusChange's output diffs so that app-layer state machines observe
+// them atomically with the block that produced them.
+type ConsensusMessage struct {
+	Kind    string
+	Payload []byte
+	Revert  bool
+}
+
+// ConsensusChange enumerates a set of changes that occurred to the
+// consensus set.
+type ConsensusChange struct {
+	// ID is a unique id for this consensus change, used by subscribers to
+	// resume from this point later.
+	ID ConsensusChangeID
+
+	// RevertedBlocks is the list of blocks that were reverted, in the order
+	// they were reverted. AppliedBlocks is the list of blocks that were
+	// applied, in the order they were applied.
+	RevertedBlocks []types.Block
+	AppliedBlocks  []types.Block
+
+	// CoinOutputDiffs and BlockStakeOutputDiffs are the set of diffs that
+	// occurred to the consensus set as a result of RevertedBlocks and
+	// AppliedBlocks.
+	CoinOutputDiffs       []CoinOutputDiff
+	BlockStakeOutputDiffs []BlockStakeOutputDiff
+
+	// Messages carries, in order, every ConsensusMessage that a registered
+	// producer attached to the blocks behind this change.
+	Messages []ConsensusMessage
+
+	// ChildTarget and MinimumValidChildTimestamp describe the requirements
+	// a block building on the new consensus set tip must satisfy.
+	ChildTarget                types.Target
+	MinimumValidChildTimestamp types.Timestamp
+
+	// Synced indicates whether the consensus set is synced with its
+	// peers, as of this consensus change.
+	Synced bool
+}
+
+// ConsensusSetSubscriber is an interface that is called automatically when
+// the consensus set changes.
+type ConsensusSetSubscriber interface {
+	// ProcessConsensusChange sends a consensus change to a subscriber.
+	ProcessConsensusChange(cc ConsensusChange)
+}